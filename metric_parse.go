@@ -0,0 +1,123 @@
+package veneur
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+)
+
+// metricPool recycles the *Metric scratch values parseMetricFast writes
+// into, so the ingest hot path (bucketPacket, called once per statsd line)
+// does not allocate a new Metric for every line.
+var metricPool = sync.Pool{
+	New: func() interface{} { return new(Metric) },
+}
+
+// parseMetricFast parses a single statsd line ("name:value|type|@rate|#tags",
+// as split out of a packet by SplitBytes) directly off of buf, writing the
+// result into scratch. Unlike ParseMetric, it never converts a substring of
+// buf to a string just to inspect it: name, type, and tag boundaries are all
+// found by scanning buf itself, and scratch.Digest is hashed straight off
+// those byte slices. The only string() conversions are the ones strconv
+// needs to parse the sample rate and the value, and the ones that intern the
+// name, type, and tags into scratch's string fields, which is the last thing
+// this function does.
+//
+// scratch is only valid for the duration of this call; the caller must
+// copy *scratch (e.g. into a batch) before parsing the next line into it,
+// and should return scratch to metricPool once done with it.
+func parseMetricFast(buf []byte, scratch *Metric) error {
+	colon := bytes.IndexByte(buf, ':')
+	if colon < 0 {
+		return fmt.Errorf("metric: no ':' found in %q", buf)
+	}
+	name := buf[:colon]
+	rest := buf[colon+1:]
+
+	bar := bytes.IndexByte(rest, '|')
+	if bar < 0 {
+		return fmt.Errorf("metric: no '|' found in %q", buf)
+	}
+	value := rest[:bar]
+	rest = rest[bar+1:]
+
+	if len(rest) == 0 {
+		return fmt.Errorf("metric: no type found in %q", buf)
+	}
+	typeEnd := bytes.IndexByte(rest, '|')
+	var typ, tail []byte
+	if typeEnd < 0 {
+		typ = rest
+	} else {
+		typ, tail = rest[:typeEnd], rest[typeEnd+1:]
+	}
+
+	sampleRate := 1.0
+	var tags []byte
+	for len(tail) > 0 {
+		fieldEnd := bytes.IndexByte(tail, '|')
+		var field []byte
+		if fieldEnd < 0 {
+			field, tail = tail, nil
+		} else {
+			field, tail = tail[:fieldEnd], tail[fieldEnd+1:]
+		}
+		if len(field) == 0 {
+			continue
+		}
+		switch field[0] {
+		case '@':
+			rate, err := strconv.ParseFloat(string(field[1:]), 64)
+			if err != nil {
+				return fmt.Errorf("metric: invalid sample rate in %q: %v", buf, err)
+			}
+			sampleRate = rate
+		case '#':
+			tags = field[1:]
+		}
+	}
+
+	// hash+intern time: apart from the sample rate parse, everything above
+	// only sliced buf, and name, type, and tags are hashed below as bytes
+	// before any of them is converted to a string.
+	h := fnv.New32a()
+	h.Write(name)
+	h.Write(typ)
+	h.Write(tags)
+	scratch.Digest = h.Sum32()
+
+	floatValue, err := strconv.ParseFloat(string(value), 64)
+	if err != nil {
+		return fmt.Errorf("metric: invalid value in %q: %v", buf, err)
+	}
+
+	scratch.Name = string(name)
+	scratch.Type = string(typ)
+	scratch.Value = floatValue
+	scratch.SampleRate = sampleRate
+	scratch.Tags = splitTagsFast(tags)
+
+	return nil
+}
+
+// splitTagsFast interns each comma-separated tag in buf into its own
+// string. An empty buf (no "#..." segment present) returns nil, matching
+// ParseMetric's behavior for metrics with no tags.
+func splitTagsFast(buf []byte) []string {
+	if len(buf) == 0 {
+		return nil
+	}
+	var tags []string
+	for len(buf) > 0 {
+		comma := bytes.IndexByte(buf, ',')
+		if comma < 0 {
+			tags = append(tags, string(buf))
+			break
+		}
+		tags = append(tags, string(buf[:comma]))
+		buf = buf[comma+1:]
+	}
+	return tags
+}
@@ -0,0 +1,43 @@
+package veneur
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMetricFast(t *testing.T) {
+	var m Metric
+	err := parseMetricFast([]byte("test.counter:1|c|@0.5|#host:a,urgent"), &m)
+	assert.NoError(t, err)
+	assert.Equal(t, "test.counter", m.Name)
+	assert.Equal(t, "c", m.Type)
+	assert.Equal(t, 1.0, m.Value)
+	assert.Equal(t, 0.5, m.SampleRate)
+	assert.Equal(t, []string{"host:a", "urgent"}, m.Tags)
+}
+
+func TestParseMetricFastDefaultSampleRateNoTags(t *testing.T) {
+	var m Metric
+	err := parseMetricFast([]byte("test.gauge:42|g"), &m)
+	assert.NoError(t, err)
+	assert.Equal(t, "test.gauge", m.Name)
+	assert.Equal(t, "g", m.Type)
+	assert.Equal(t, 42.0, m.Value)
+	assert.Equal(t, 1.0, m.SampleRate)
+	assert.Nil(t, m.Tags)
+}
+
+func TestParseMetricFastDigestIgnoresValue(t *testing.T) {
+	var a, b Metric
+	assert.NoError(t, parseMetricFast([]byte("test.counter:1|c|#host:a"), &a))
+	assert.NoError(t, parseMetricFast([]byte("test.counter:99|c|#host:a"), &b))
+	assert.Equal(t, a.Digest, b.Digest, "digest should depend on name/type/tags, not value")
+}
+
+func TestParseMetricFastErrors(t *testing.T) {
+	var m Metric
+	assert.Error(t, parseMetricFast([]byte("no-colon-or-bar"), &m))
+	assert.Error(t, parseMetricFast([]byte("test.counter:1"), &m), "missing '|'")
+	assert.Error(t, parseMetricFast([]byte("test.counter:notanumber|c"), &m))
+}
@@ -2,8 +2,11 @@ package veneur
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
@@ -28,19 +31,79 @@ type Server struct {
 	DDAPIKey   string
 	HTTPClient *http.Client
 
+	Sinks    []Sink
+	Interval time.Duration
+
+	// sinkMu guards sinkIntervals, sinkLastFlush, and sinkPending, which
+	// together let Flush give each sink its own schedule instead of
+	// flushing all of them every cycle. sinkPending accumulates the
+	// metrics from every tick a sink wasn't due on, so a sink only gets
+	// flushed what happened since its own last flush, not just the one
+	// tick it happened to become due on.
+	sinkMu        sync.Mutex
+	sinkIntervals map[string]time.Duration
+	sinkLastFlush map[string]time.Time
+	sinkPending   map[string][]DDMetric
+
 	HTTPAddr    string
 	UDPAddr     *net.UDPAddr
 	RcvbufBytes int
+	NumReaders  int
+
+	UnixAddr     *net.UnixAddr
+	UnixSockMode os.FileMode
 
 	HistogramPercentiles []float64
+
+	shutdown chan struct{}
+
+	// readerWG tracks the ReadSocket/ReadUnixSocket goroutines. Each one's
+	// caller must call Add(1) before starting it, so Shutdown's Wait()
+	// cannot return before every reader has actually registered.
+	readerWG sync.WaitGroup
+	workerWG sync.WaitGroup
+
+	// connMu guards udpConns/unixConn, and also covers each reader's
+	// shutdown check: Shutdown closes s.shutdown, then under connMu closes
+	// every registered conn. A reader must check s.shutdown and register
+	// its conn under that same lock, or a Shutdown landing between an
+	// unlocked check and an unlocked register could finish its close loop
+	// before the reader ever appears here, leaking the conn and
+	// deadlocking readerWG.Wait() forever.
+	connMu     sync.Mutex
+	udpConns   []*net.UDPConn
+	unixConn   *net.UnixConn
+	packetPool *sync.Pool
 }
 
-func NewFromConfig(conf Config) (ret Server, err error) {
+// maxUDPPacketSize bounds the buffers handed out by packetPool; statsd
+// datagrams are well under the common network MTU, so a fixed size avoids
+// having to thread a config value all the way down to the pool.
+const maxUDPPacketSize = 2048
+
+func NewFromConfig(conf Config) (*Server, error) {
+	ret := &Server{}
+	err := ret.init(conf)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// init populates ret from conf and starts its worker and reader goroutines.
+// It is split out of NewFromConfig so that every goroutine it spawns closes
+// over the same *Server the caller gets back, instead of a pre-return value
+// copy: Server embeds a sync.Mutex and sync.WaitGroups, so returning it by
+// value would hand the caller a copy whose readerWG/workerWG are never
+// touched by the real goroutines and whose udpConns/unixConn never get
+// populated, leaving Shutdown() hanging forever on the caller's copy.
+func (ret *Server) init(conf Config) (err error) {
 	ret.Hostname = conf.Hostname
 	ret.Tags = conf.Tags
 	ret.DDHostname = conf.APIHostname
 	ret.DDAPIKey = conf.Key
 	ret.HistogramPercentiles = conf.Percentiles
+	ret.Interval = conf.Interval
 
 	ret.HTTPClient = &http.Client{
 		// make sure that POSTs to datadog do not overflow the flush interval
@@ -48,6 +111,25 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 		// we're fine with using the default transport and redirect behavior
 	}
 
+	ret.Sinks = append(ret.Sinks, &datadogSink{
+		hostname:   ret.DDHostname,
+		apiKey:     ret.DDAPIKey,
+		httpClient: ret.HTTPClient,
+	})
+	ret.sinkIntervals = make(map[string]time.Duration)
+	ret.sinkLastFlush = make(map[string]time.Time)
+	for _, sc := range conf.Sinks {
+		var sink Sink
+		sink, err = newSink(sc)
+		if err != nil {
+			return
+		}
+		ret.Sinks = append(ret.Sinks, sink)
+		if sc.Interval != 0 {
+			ret.sinkIntervals[sink.Name()] = sc.Interval
+		}
+	}
+
 	ret.statsd, err = statsd.NewBuffered(conf.StatsAddr, 1024)
 	if err != nil {
 		return
@@ -78,12 +160,16 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 		},
 	})
 
+	ret.shutdown = make(chan struct{})
+
 	ret.logger.WithField("number", conf.NumWorkers).Info("Starting workers")
 	ret.Workers = make([]*Worker, conf.NumWorkers)
+	ret.workerWG.Add(conf.NumWorkers)
 	for i := range ret.Workers {
 		ret.Workers[i] = NewWorker(i+1, ret.statsd, ret.logger)
 		// do not close over loop index
 		go func(w *Worker) {
+			defer ret.workerWG.Done()
 			defer func() {
 				ret.ConsumePanic(recover())
 			}()
@@ -98,6 +184,26 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 	ret.RcvbufBytes = conf.ReadBufferSizeBytes
 	ret.HTTPAddr = conf.HTTPAddr
 
+	ret.NumReaders = conf.NumReaders
+	if ret.NumReaders == 0 {
+		ret.NumReaders = 1
+	}
+
+	// the unix socket listener is optional; an empty path disables it so
+	// that hosts without a sidecar-mounted socket aren't forced to set one up
+	if conf.UnixAddr != "" {
+		ret.UnixAddr, err = net.ResolveUnixAddr("unixgram", conf.UnixAddr)
+		if err != nil {
+			return
+		}
+		ret.UnixSockMode = os.FileMode(conf.UnixSockMode)
+		if ret.UnixSockMode == 0 {
+			ret.UnixSockMode = 0660
+		}
+	}
+
+	ret.startReaders()
+
 	conf.Key = "REDACTED"
 	conf.SentryDSN = "REDACTED"
 	ret.logger.WithField("config", conf).Debug("Initialized server")
@@ -105,26 +211,195 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 	return
 }
 
+// startReaders spawns s.NumReaders UDP reader goroutines, each with its
+// own SO_REUSEPORT socket so the kernel load-balances datagrams across
+// them, plus one unix socket reader if s.UnixAddr is set. It must be
+// called after s.UDPAddr, s.RcvbufBytes, s.NumReaders, and s.UnixAddr are
+// finalized.
+func (s *Server) startReaders() {
+	s.packetPool = &sync.Pool{
+		New: func() interface{} {
+			return make([]byte, maxUDPPacketSize)
+		},
+	}
+
+	for i := 0; i < s.NumReaders; i++ {
+		// Add happens here, before the goroutine is scheduled, so that
+		// Shutdown's s.readerWG.Wait() cannot return early simply because
+		// the goroutine hasn't run yet
+		s.readerWG.Add(1)
+		go func(reader int) {
+			defer s.readerWG.Done()
+			defer func() {
+				s.ConsumePanic(recover())
+			}()
+			s.ReadSocket(s.packetPool, reader)
+		}(i)
+	}
+
+	if s.UnixAddr != nil {
+		s.readerWG.Add(1)
+		go func() {
+			defer s.readerWG.Done()
+			defer func() {
+				s.ConsumePanic(recover())
+			}()
+			s.ReadUnixSocket(s.packetPool)
+		}()
+	}
+}
+
 func (s *Server) HandlePacket(packet []byte) {
-	metric, err := ParseMetric(packet)
+	scratch := metricPool.Get().(*Metric)
+	err := parseMetricFast(packet, scratch)
 	if err != nil {
 		s.logger.WithFields(logrus.Fields{
 			logrus.ErrorKey: err,
 			"packet":        string(packet),
 		}).Error("Could not parse packet")
 		s.statsd.Count("packet.error_total", 1, nil, 1.0)
+		metricPool.Put(scratch)
 		return
 	}
 
-	s.Workers[metric.Digest%uint32(len(s.Workers))].PacketChan <- *metric
+	metric := *scratch
+	metricPool.Put(scratch)
+	s.Workers[metric.Digest%uint32(len(s.Workers))].PacketChan <- []Metric{metric}
+}
+
+// bucketPacket parses a single statsd line (as split out of a UDP or unix
+// datagram by SplitBytes) using parseMetricFast's byte-slice scanning, and
+// appends the result to the batch belonging to the worker that will own it,
+// instead of sending it to that worker's PacketChan immediately. This
+// amortizes channel-send overhead across every metric in a batch (see
+// flushBatches) on top of parseMetricFast's own allocation savings over the
+// old per-chunk ParseMetric call. Parse errors are logged and counted
+// exactly as HandlePacket does, but do not grow any batch.
+func (s *Server) bucketPacket(packet []byte, batches [][]Metric) [][]Metric {
+	scratch := metricPool.Get().(*Metric)
+	err := parseMetricFast(packet, scratch)
+	if err != nil {
+		s.logger.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"packet":        string(packet),
+		}).Error("Could not parse packet")
+		s.statsd.Count("packet.error_total", 1, nil, 1.0)
+		metricPool.Put(scratch)
+		return batches
+	}
+
+	idx := scratch.Digest % uint32(len(batches))
+	batches[idx] = append(batches[idx], *scratch)
+	metricPool.Put(scratch)
+	return batches
+}
+
+// flushBatches sends each worker's accumulated batch as a single channel
+// send, amortizing channel-send overhead across every metric bucketed to
+// that worker since batches was last flushed. The returned slice has each
+// flushed entry reset to nil, so the caller can keep reusing the outer
+// slice across reads without aliasing a batch a Worker may still be
+// draining.
+func (s *Server) flushBatches(batches [][]Metric) [][]Metric {
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		s.Workers[i].PacketChan <- batch
+		batches[i] = nil
+	}
+	return batches
+}
+
+// Flush collects the metrics accumulated by each Worker since the last
+// flush and dispatches them to every configured Sink concurrently. A sink
+// whose own SinkConfig.Interval hasn't elapsed yet has this tick's metrics
+// buffered for it rather than dropped, so it sees everything produced
+// since its own last flush once it is next due. A sink that errors does
+// not prevent the others from receiving the flush.
+func (s *Server) Flush(ctx context.Context) {
+	s.flush(ctx, false)
+}
+
+// flush is Flush's implementation. When force is true (used by Shutdown's
+// final flush), every sink is flushed regardless of its own schedule, since
+// there won't be another cycle to catch up on.
+func (s *Server) flush(ctx context.Context, force bool) {
+	var ddmetrics []DDMetric
+	for _, w := range s.Workers {
+		ddmetrics = append(ddmetrics, w.Flush(s.Interval)...)
+	}
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	for _, sink := range s.Sinks {
+		pending, due := s.sinkPendingFlush(sink, ddmetrics, now, force)
+		if !due {
+			continue
+		}
+
+		wg.Add(1)
+		go func(sink Sink, metrics []DDMetric) {
+			defer wg.Done()
+			if err := sink.Flush(ctx, metrics); err != nil {
+				s.logger.WithFields(logrus.Fields{
+					logrus.ErrorKey: err,
+					"sink":          sink.Name(),
+				}).Error("Error flushing to sink")
+				s.statsd.Count("flush.error_total", 1, []string{"sink:" + sink.Name()}, 1.0)
+			}
+		}(sink, pending)
+	}
+	wg.Wait()
 }
 
-func (s *Server) ReadSocket(packetPool *sync.Pool) {
-	// each goroutine gets its own socket
-	// if the sockets support SO_REUSEPORT, then this will cause the
-	// kernel to distribute datagrams across them, for better read
-	// performance
-	s.logger.WithField("address", s.UDPAddr).Info("UDP server listening")
+// sinkPendingFlush merges ddmetrics into sink's pending buffer, and, if
+// sink is due to flush (or force is set), returns that buffer and clears
+// it. Merging rather than overwriting is what lets a sink with an interval
+// longer than the base tick see every tick it skipped once it is finally
+// due, instead of only the single tick it happened to be due on. A sink
+// that has never been flushed is always due, so it starts from an empty
+// backlog rather than however long the server happened to already be
+// running. A sink with no SinkConfig.Interval override is due on every call.
+func (s *Server) sinkPendingFlush(sink Sink, ddmetrics []DDMetric, now time.Time, force bool) ([]DDMetric, bool) {
+	name := sink.Name()
+
+	s.sinkMu.Lock()
+	defer s.sinkMu.Unlock()
+
+	interval, hasOverride := s.sinkIntervals[name]
+	if s.sinkPending == nil {
+		s.sinkPending = make(map[string][]DDMetric)
+	}
+	s.sinkPending[name] = append(s.sinkPending[name], ddmetrics...)
+
+	last, seen := s.sinkLastFlush[name]
+	if !force && hasOverride && seen && now.Sub(last) < interval {
+		return nil, false
+	}
+
+	pending := s.sinkPending[name]
+	s.sinkPending[name] = nil
+	if s.sinkLastFlush == nil {
+		s.sinkLastFlush = make(map[string]time.Time)
+	}
+	s.sinkLastFlush[name] = now
+	return pending, true
+}
+
+// ReadSocket reads statsd packets from a UDP socket bound to s.UDPAddr,
+// tagging its packet.received_total count with reader, its index among the
+// s.NumReaders goroutines started by startReaders. Each call gets its own
+// socket; since the sockets share SO_REUSEPORT, the kernel distributes
+// datagrams across them for better read performance. See readerWG's and
+// connMu's doc comments for this method's registration contract.
+func (s *Server) ReadSocket(packetPool *sync.Pool, reader int) {
+	readerTag := []string{fmt.Sprintf("reader:%d", reader)}
+
+	s.logger.WithFields(logrus.Fields{
+		"address": s.UDPAddr,
+		"reader":  reader,
+	}).Info("UDP server listening")
 	serverConn, err := NewSocket(s.UDPAddr, s.RcvbufBytes)
 	if err != nil {
 		// if any goroutine fails to create the socket, we can't really
@@ -134,13 +409,34 @@ func (s *Server) ReadSocket(packetPool *sync.Pool) {
 		s.logger.WithError(err).Fatal("Error listening for UDP")
 	}
 
+	s.connMu.Lock()
+	select {
+	case <-s.shutdown:
+		s.connMu.Unlock()
+		serverConn.Close()
+		return
+	default:
+	}
+	s.udpConns = append(s.udpConns, serverConn)
+	s.connMu.Unlock()
+
+	batches := make([][]Metric, len(s.Workers))
+
 	for {
 		buf := packetPool.Get().([]byte)
 		n, _, err := serverConn.ReadFrom(buf)
 		if err != nil {
+			// Shutdown closes serverConn to break us out of ReadFrom; treat
+			// that as a clean exit rather than an error worth logging
+			select {
+			case <-s.shutdown:
+				return
+			default:
+			}
 			s.logger.WithError(err).Error("Error reading from UDP")
 			continue
 		}
+		s.statsd.Count("packet.received_total", 1, readerTag, 1.0)
 
 		// statsd allows multiple packets to be joined by newlines and sent as
 		// one larger packet
@@ -149,15 +445,111 @@ func (s *Server) ReadSocket(packetPool *sync.Pool) {
 		// trailing newlines
 		splitPacket := NewSplitBytes(buf[:n], '\n')
 		for splitPacket.Next() {
-			s.HandlePacket(splitPacket.Chunk())
+			batches = s.bucketPacket(splitPacket.Chunk(), batches)
+		}
+
+		// every Metric bucketed above is a value copy with no byte slices
+		// into buf, only strings, so there are no outstanding references to
+		// this byte slice once bucketPacket returns; we can return it to
+		// the pool immediately, before the batch is even flushed
+		packetPool.Put(buf)
+
+		batches = s.flushBatches(batches)
+	}
+}
+
+// ReadUnixSocket listens for statsd packets on a Unix domain datagram
+// socket, in addition to (or instead of) the UDP listener set up by
+// ReadSocket. This is useful on hosts where UDP is lossy or restricted, or
+// for sidecar containers that share a mounted socket path with veneur. See
+// readerWG's and connMu's doc comments for this method's registration
+// contract.
+func (s *Server) ReadUnixSocket(packetPool *sync.Pool) {
+	s.logger.WithField("address", s.UnixAddr).Info("Unix socket server listening")
+
+	// the socket file must not already exist, or ListenUnixgram will fail
+	// with "address already in use"
+	if err := os.Remove(s.UnixAddr.Name); err != nil && !os.IsNotExist(err) {
+		s.logger.WithError(err).Fatal("Error removing existing unix socket")
+	}
+
+	serverConn, err := net.ListenUnixgram("unixgram", s.UnixAddr)
+	if err != nil {
+		s.logger.WithError(err).Fatal("Error listening on unix socket")
+	}
+	defer os.Remove(s.UnixAddr.Name)
+
+	s.connMu.Lock()
+	select {
+	case <-s.shutdown:
+		s.connMu.Unlock()
+		serverConn.Close()
+		return
+	default:
+	}
+	s.unixConn = serverConn
+	s.connMu.Unlock()
+
+	if err := os.Chmod(s.UnixAddr.Name, s.UnixSockMode); err != nil {
+		s.logger.WithError(err).Fatal("Error setting unix socket permissions")
+	}
+
+	batches := make([][]Metric, len(s.Workers))
+
+	for {
+		buf := packetPool.Get().([]byte)
+		n, _, err := serverConn.ReadFrom(buf)
+		if err != nil {
+			// Shutdown closes serverConn to break us out of ReadFrom; treat
+			// that as a clean exit rather than an error worth logging
+			select {
+			case <-s.shutdown:
+				return
+			default:
+			}
+			s.logger.WithError(err).Error("Error reading from unix socket")
+			continue
+		}
+
+		splitPacket := NewSplitBytes(buf[:n], '\n')
+		for splitPacket.Next() {
+			batches = s.bucketPacket(splitPacket.Chunk(), batches)
 		}
 
-		// the Metric struct created by HandlePacket has no byte slices in it,
-		// only strings
-		// therefore there are no outstanding references to this byte slice, we
-		// can return it to the pool
 		packetPool.Put(buf)
+
+		batches = s.flushBatches(batches)
+	}
+}
+
+// Shutdown stops ingestion and drains in-flight packets before returning.
+// It closes the UDP and unix socket listeners (which breaks their ReadFrom
+// loops), waits for the reader goroutines to exit, then closes each
+// Worker's PacketChan and waits for Work() to finish draining it, and
+// finally performs one last flush to every sink, regardless of each sink's
+// own schedule, so nothing buffered is lost. It is safe to call exactly
+// once.
+func (s *Server) Shutdown() {
+	s.logger.Info("Shutting down, draining in-flight packets")
+	close(s.shutdown)
+
+	s.connMu.Lock()
+	for _, conn := range s.udpConns {
+		conn.Close()
+	}
+	if s.unixConn != nil {
+		s.unixConn.Close()
 	}
+	s.connMu.Unlock()
+	s.readerWG.Wait()
+
+	for _, w := range s.Workers {
+		close(w.PacketChan)
+	}
+	s.workerWG.Wait()
+
+	s.logger.Info("Performing final flush")
+	s.flush(context.Background(), true)
 }
 
 func (s *Server) HTTPServe() {
@@ -165,6 +557,7 @@ func (s *Server) HTTPServe() {
 	graceful.Timeout(10 * time.Second)
 	graceful.PreHook(func() {
 		s.logger.Info("Terminating HTTP listener")
+		s.Shutdown()
 	})
 	graceful.HandleSignals()
 	s.logger.WithField("address", s.HTTPAddr).Info("HTTP server listening")
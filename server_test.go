@@ -0,0 +1,338 @@
+package veneur
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// capturingSink records every metric it is asked to flush, so tests can
+// assert on what actually made it through a graceful shutdown.
+type capturingSink struct {
+	mu      sync.Mutex
+	name    string
+	flushed []DDMetric
+	flushes int
+}
+
+func (c *capturingSink) Name() string {
+	if c.name == "" {
+		return "capturing"
+	}
+	return c.name
+}
+
+func (c *capturingSink) Flush(ctx context.Context, metrics []DDMetric) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushed = append(c.flushed, metrics...)
+	c.flushes++
+	return nil
+}
+
+func (c *capturingSink) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.flushed)
+}
+
+func (c *capturingSink) flushCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushes
+}
+
+func TestShutdownDrainsInFlightPackets(t *testing.T) {
+	logger := logrus.New()
+	sink := &capturingSink{}
+
+	s := &Server{
+		logger:   logger,
+		statsd:   nilStatsd(t),
+		Sinks:    []Sink{sink},
+		Interval: time.Second,
+		shutdown: make(chan struct{}),
+	}
+
+	const numWorkers = 4
+	s.Workers = make([]*Worker, numWorkers)
+	for i := range s.Workers {
+		s.Workers[i] = NewWorker(i+1, s.statsd, logger)
+		s.workerWG.Add(1)
+		go func(w *Worker) {
+			defer s.workerWG.Done()
+			w.Work()
+		}(s.Workers[i])
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s.UDPAddr = addr
+
+	packetPool := &sync.Pool{
+		New: func() interface{} {
+			return make([]byte, 1024)
+		},
+	}
+	s.readerWG.Add(1)
+	go func() {
+		defer s.readerWG.Done()
+		s.ReadSocket(packetPool, 0)
+	}()
+	// give ReadSocket a moment to bind before we discover its address
+	time.Sleep(50 * time.Millisecond)
+
+	s.connMu.Lock()
+	boundAddr := s.udpConns[0].LocalAddr().(*net.UDPAddr)
+	s.connMu.Unlock()
+
+	const numPackets = 20
+	client, err := net.DialUDP("udp", nil, boundAddr)
+	assert.NoError(t, err)
+	for i := 0; i < numPackets; i++ {
+		_, err := client.Write([]byte("test.counter:1|c"))
+		assert.NoError(t, err)
+	}
+	client.Close()
+
+	// let the reader goroutine drain the socket before we shut down
+	time.Sleep(50 * time.Millisecond)
+
+	s.Shutdown()
+
+	assert.Equal(t, 1, sink.count(), "all in-flight packets should collapse into a single counter flush")
+	assert.Equal(t, float64(numPackets), sink.flushed[0].Value, "the final flush should reflect every packet sent, not just however many happened to make it through")
+}
+
+func TestNumReadersFanOut(t *testing.T) {
+	logger := logrus.New()
+
+	s := &Server{
+		logger:     logger,
+		statsd:     nilStatsd(t),
+		shutdown:   make(chan struct{}),
+		NumReaders: 3,
+	}
+	s.Workers = []*Worker{NewWorker(1, s.statsd, logger)}
+	s.workerWG.Add(1)
+	go func() {
+		defer s.workerWG.Done()
+		s.Workers[0].Work()
+	}()
+
+	// grab a free port and release it immediately, so every reader socket
+	// can bind the same address via SO_REUSEPORT
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	assert.NoError(t, err)
+	addr := probe.LocalAddr().(*net.UDPAddr)
+	assert.NoError(t, probe.Close())
+	s.UDPAddr = addr
+
+	s.startReaders()
+	defer s.Shutdown()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.connMu.Lock()
+		n := len(s.udpConns)
+		s.connMu.Unlock()
+		if n == s.NumReaders {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d readers to register a socket, only saw %d", s.NumReaders, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestShutdownImmediatelyAfterStart calls Shutdown with no delay at all
+// after starting a reader, so that s.readerWG.Add(1) happening at the call
+// site (rather than as the first statement inside ReadSocket) is actually
+// exercised: if Add raced with Shutdown's Wait, Shutdown would close
+// w.PacketChan while the reader was still alive, and a subsequent
+// flushBatches send on it would panic instead of this test completing.
+func TestShutdownImmediatelyAfterStart(t *testing.T) {
+	logger := logrus.New()
+
+	s := &Server{
+		logger:   logger,
+		statsd:   nilStatsd(t),
+		shutdown: make(chan struct{}),
+	}
+	s.Workers = []*Worker{NewWorker(1, s.statsd, logger)}
+	s.workerWG.Add(1)
+	go func() {
+		defer s.workerWG.Done()
+		s.Workers[0].Work()
+	}()
+
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s.UDPAddr = addr
+
+	packetPool := &sync.Pool{
+		New: func() interface{} {
+			return make([]byte, 1024)
+		},
+	}
+
+	s.readerWG.Add(1)
+	go func() {
+		defer s.readerWG.Done()
+		s.ReadSocket(packetPool, 0)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Shutdown()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return; reader registration likely raced Shutdown's close loop")
+	}
+}
+
+// TestNewFromConfigShutdown boots a server the way production code does —
+// through NewFromConfig, not a &Server{} literal — and drives it through
+// Shutdown, the same path graceful.PreHook exercises on SIGTERM. This
+// catches NewFromConfig returning a Server whose goroutines close over a
+// different copy than the one the caller got back: if that happened,
+// Shutdown below would hang on s.readerWG.Wait()/s.workerWG.Wait() instead
+// of ever reaching the assertion.
+func TestNewFromConfigShutdown(t *testing.T) {
+	sink := &capturingSink{}
+
+	conf := Config{
+		Hostname:    "test-host",
+		APIHostname: "http://localhost:1",
+		Key:         "test-key",
+		Percentiles: []float64{0.5, 0.99},
+		Interval:    time.Second,
+		StatsAddr:   "127.0.0.1:8125",
+		NumWorkers:  2,
+		UDPAddr:     "127.0.0.1:0",
+	}
+
+	s, err := NewFromConfig(conf)
+	assert.NoError(t, err)
+	s.Sinks = []Sink{sink}
+
+	// give the reader goroutine a moment to bind before we discover its
+	// address
+	time.Sleep(50 * time.Millisecond)
+
+	s.connMu.Lock()
+	boundAddr := s.udpConns[0].LocalAddr().(*net.UDPAddr)
+	s.connMu.Unlock()
+
+	const numPackets = 20
+	client, err := net.DialUDP("udp", nil, boundAddr)
+	assert.NoError(t, err)
+	for i := 0; i < numPackets; i++ {
+		_, err := client.Write([]byte("test.counter:1|c"))
+		assert.NoError(t, err)
+	}
+	client.Close()
+
+	// let the reader goroutine drain the socket before we shut down
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Shutdown()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return; NewFromConfig's goroutines likely closed over a different *Server than the caller received")
+	}
+
+	assert.Equal(t, 1, sink.count(), "all in-flight packets should collapse into a single counter flush")
+	assert.Equal(t, float64(numPackets), sink.flushed[0].Value, "the final flush should reflect every packet sent, not just however many happened to make it through")
+}
+
+// TestFlushRespectsPerSinkInterval checks that a sink with a SinkConfig.
+// Interval longer than the server's default Interval is skipped on cycles
+// where it isn't due yet, while a sink with no override flushes every
+// cycle.
+func TestFlushRespectsPerSinkInterval(t *testing.T) {
+	fast := &capturingSink{name: "fast"}
+	slow := &capturingSink{name: "slow"}
+
+	s := &Server{
+		logger:   logrus.New(),
+		statsd:   nilStatsd(t),
+		Sinks:    []Sink{fast, slow},
+		Interval: time.Millisecond,
+		shutdown: make(chan struct{}),
+		sinkIntervals: map[string]time.Duration{
+			"slow": time.Hour,
+		},
+	}
+	s.Workers = []*Worker{NewWorker(1, s.statsd, s.logger)}
+
+	s.Flush(context.Background())
+	s.Flush(context.Background())
+	s.Flush(context.Background())
+
+	assert.Equal(t, 3, fast.flushCount(), "a sink with no interval override should flush every cycle")
+	assert.Equal(t, 1, slow.flushCount(), "a sink whose hour-long interval hasn't elapsed should only flush once")
+}
+
+// TestFlushBuffersSkippedCyclesForSlowSink checks that the ticks a
+// not-yet-due sink skips aren't lost: their metrics must still reach the
+// sink, merged into whichever flush it's next due for, rather than only
+// the single tick it happened to be due on.
+func TestFlushBuffersSkippedCyclesForSlowSink(t *testing.T) {
+	slow := &capturingSink{name: "slow"}
+
+	s := &Server{
+		logger:   logrus.New(),
+		statsd:   nilStatsd(t),
+		Sinks:    []Sink{slow},
+		Interval: time.Millisecond,
+		shutdown: make(chan struct{}),
+		sinkIntervals: map[string]time.Duration{
+			"slow": time.Hour,
+		},
+	}
+	s.Workers = []*Worker{NewWorker(1, s.statsd, s.logger)}
+
+	// the first flush is always due, regardless of interval, so it should
+	// go out immediately with nothing buffered yet
+	s.Flush(context.Background())
+	assert.Equal(t, 1, slow.flushCount())
+
+	// none of these ticks are due yet; each one's counter must be buffered
+	// rather than dropped
+	const skippedTicks = 3
+	for i := 0; i < skippedTicks; i++ {
+		s.Workers[0].ProcessMetric(&Metric{Name: "test.counter", Type: "counter", Value: 1, Digest: 1, SampleRate: 1})
+		s.Flush(context.Background())
+	}
+	assert.Equal(t, 1, slow.flushCount(), "the sink should still be within its hour-long interval")
+
+	// force a flush, as Shutdown's final flush does, and confirm every
+	// skipped tick's metric made it through, not just the latest one
+	s.flush(context.Background(), true)
+	assert.Equal(t, 2, slow.flushCount())
+	assert.Len(t, slow.flushed, skippedTicks, "every buffered tick should have been delivered once the sink finally flushed")
+}
+
+func nilStatsd(t *testing.T) *statsd.Client {
+	c, err := statsd.NewBuffered("127.0.0.1:8125", 1024)
+	assert.NoError(t, err)
+	return c
+}
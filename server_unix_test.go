@@ -0,0 +1,83 @@
+package veneur
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadUnixSocketHandlesPacket(t *testing.T) {
+	logger := logrus.New()
+	sink := &capturingSink{}
+
+	sockPath := filepath.Join(t.TempDir(), "veneur.sock")
+	unixAddr, err := net.ResolveUnixAddr("unixgram", sockPath)
+	assert.NoError(t, err)
+
+	s := &Server{
+		logger:       logger,
+		statsd:       nilStatsd(t),
+		Sinks:        []Sink{sink},
+		Interval:     time.Second,
+		shutdown:     make(chan struct{}),
+		UnixAddr:     unixAddr,
+		UnixSockMode: 0660,
+	}
+
+	s.Workers = []*Worker{NewWorker(1, s.statsd, logger)}
+	s.workerWG.Add(1)
+	go func() {
+		defer s.workerWG.Done()
+		s.Workers[0].Work()
+	}()
+
+	packetPool := &sync.Pool{
+		New: func() interface{} {
+			return make([]byte, 1024)
+		},
+	}
+
+	s.readerWG.Add(1)
+	go func() {
+		defer s.readerWG.Done()
+		s.ReadUnixSocket(packetPool)
+	}()
+
+	// wait for the socket file to show up and have its final mode set
+	// before dialing it; ListenUnixgram creates the file with a
+	// umask-derived mode and ReadUnixSocket only os.Chmods it to
+	// UnixSockMode afterward, so seeing the file is not enough to know its
+	// permissions have settled
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if info, err := os.Stat(sockPath); err == nil && info.Mode().Perm() == 0660 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("unix socket file was never created with the expected permissions")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client, err := net.DialUnix("unixgram", nil, unixAddr)
+	assert.NoError(t, err)
+	_, err = client.Write([]byte("test.counter:1|c"))
+	assert.NoError(t, err)
+	client.Close()
+
+	// let the reader goroutine drain the socket before we shut down
+	time.Sleep(50 * time.Millisecond)
+
+	s.Shutdown()
+
+	assert.Equal(t, 1, sink.count(), "the packet sent over the unix socket should have been flushed")
+
+	_, err = os.Stat(sockPath)
+	assert.True(t, os.IsNotExist(err), "Shutdown should remove the socket file")
+}
@@ -0,0 +1,96 @@
+package veneur
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Sink is a flush destination for the metrics veneur aggregates. Each sink
+// is flushed independently on its own schedule (SinkConfig.Interval, or the
+// server's Interval if unset) and with its own retry policy, so a slow or
+// unreachable sink cannot hold up the others.
+type Sink interface {
+	// Name identifies the sink in logs and in the "sink" tag on veneur's
+	// own flush.error_total metric.
+	Name() string
+
+	// Flush delivers a batch of aggregated metrics to the sink's backend.
+	// It should respect ctx's deadline/cancellation.
+	Flush(ctx context.Context, metrics []DDMetric) error
+}
+
+// SinkConfig describes one additionally-registered sink in the veneur
+// config file. The Datadog sink is always present (built from DDHostname/
+// DDAPIKey/HTTPClient) and does not need an entry here.
+type SinkConfig struct {
+	// Type selects the sink implementation: "prometheus" or "otlp".
+	Type string `yaml:"type"`
+
+	// URL is the endpoint the sink POSTs to: a Prometheus remote-write
+	// endpoint, or an OTLP/HTTP metrics endpoint.
+	URL string `yaml:"url"`
+
+	// Interval overrides how often this sink is flushed. Zero means "use
+	// the server's default Interval".
+	Interval time.Duration `yaml:"interval"`
+
+	// MaxRetries bounds how many times Flush retries a failed POST to URL
+	// (so it makes at most MaxRetries+1 attempts) before giving up and
+	// returning an error for this flush cycle.
+	MaxRetries int `yaml:"max_retries"`
+}
+
+func newSink(conf SinkConfig) (Sink, error) {
+	switch conf.Type {
+	case "prometheus":
+		return newPrometheusSink(conf)
+	case "otlp":
+		return newOTLPSink(conf)
+	default:
+		return nil, fmt.Errorf("sink: unknown sink type %q", conf.Type)
+	}
+}
+
+// datadogSink posts metrics to the Datadog HTTP API, preserving veneur's
+// original (and still default) flush behavior.
+type datadogSink struct {
+	hostname   string
+	apiKey     string
+	httpClient *http.Client
+}
+
+func (dd *datadogSink) Name() string {
+	return "datadog"
+}
+
+func (dd *datadogSink) Flush(ctx context.Context, metrics []DDMetric) error {
+	body, err := json.Marshal(struct {
+		Series []DDMetric `json:"series"`
+	}{metrics})
+	if err != nil {
+		return fmt.Errorf("datadog sink: marshaling series: %v", err)
+	}
+
+	url := fmt.Sprintf("%s/api/v1/series?api_key=%s", dd.hostname, dd.apiKey)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("datadog sink: building request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+
+	resp, err := dd.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("datadog sink: POST failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("datadog sink: unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package veneur
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+// otlpSink exports metrics over OTLP/HTTP, serialized as a protobuf
+// ExportMetricsServiceRequest.
+//
+// veneur's gauges and counters map directly onto OTLP gauge/sum data
+// points. Histograms are exported as OTLP ExponentialHistogram data
+// points, with each pre-computed percentile value counted into the
+// exponential bucket it falls into, since veneur's original sample stream
+// is not retained after flush.
+type otlpSink struct {
+	url        string
+	httpClient *http.Client
+	maxRetries int
+}
+
+func newOTLPSink(conf SinkConfig) (Sink, error) {
+	if conf.URL == "" {
+		return nil, fmt.Errorf("otlp sink: URL is required")
+	}
+	return &otlpSink{
+		url:        conf.URL,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		maxRetries: conf.MaxRetries,
+	}, nil
+}
+
+func (o *otlpSink) Name() string {
+	return "otlp"
+}
+
+func (o *otlpSink) Flush(ctx context.Context, metrics []DDMetric) error {
+	req := &collectorpb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricpb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{
+				Attributes: []*commonpb.KeyValue{{
+					Key:   "service.name",
+					Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "veneur"}},
+				}},
+			},
+			ScopeMetrics: []*metricpb.ScopeMetrics{{
+				Metrics: metricsToOTLP(metrics),
+			}},
+		}},
+	}
+
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("otlp sink: marshaling ExportMetricsServiceRequest: %v", err)
+	}
+
+	var lastErr error
+	attempts := o.maxRetries + 1
+	for attempt := 0; attempt < attempts; attempt++ {
+		if lastErr != nil {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+		if lastErr = o.send(ctx, data); lastErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("otlp sink: giving up after %d attempts: %v", attempts, lastErr)
+}
+
+func (o *otlpSink) send(ctx context.Context, body []byte) error {
+	httpReq, err := http.NewRequest("POST", o.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building request: %v", err)
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := o.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("POST failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// metricsToOTLP converts veneur's DDMetrics into OTLP Metric protos,
+// dispatching on veneur's metric type string ("counter", "gauge", or
+// "histogram").
+//
+// veneur flushes one histogram DDMetric per percentile (eg "latency" with a
+// "p50" tag, another "latency" with a "p99" tag, ...), all sharing the same
+// name and non-percentile tags. Those are collected into a single
+// ExponentialHistogramDataPoint per distinct (name, tags) group, with each
+// percentile's value placed in the exponential bucket it falls into - the
+// closest approximation OTLP's format allows without veneur's original
+// sample stream, which is not retained after flush.
+func metricsToOTLP(metrics []DDMetric) []*metricpb.Metric {
+	out := make([]*metricpb.Metric, 0, len(metrics))
+	histograms := make(map[string]*histogramGroup)
+	var histogramOrder []string
+
+	for _, m := range metrics {
+		pctTag, isHistogramPercentile := "", false
+		if m.Type == "histogram" {
+			pctTag, isHistogramPercentile = percentileTag(m)
+		}
+
+		attrs := make([]*commonpb.KeyValue, 0, len(m.Tags))
+		for _, tag := range m.Tags {
+			if isHistogramPercentile && tag == pctTag {
+				// the percentile tag distinguishes data points within one
+				// DDMetric series, not the series itself; it is consumed by
+				// histogramGroupKey/bucketing below, not re-exposed as a label
+				continue
+			}
+			name, value := splitTag(tag)
+			attrs = append(attrs, &commonpb.KeyValue{
+				Key:   name,
+				Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+			})
+		}
+
+		switch m.Type {
+		case "counter":
+			out = append(out, &metricpb.Metric{
+				Name: m.Name,
+				Data: &metricpb.Metric_Sum{Sum: &metricpb.Sum{
+					AggregationTemporality: metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+					IsMonotonic:            true,
+					DataPoints: []*metricpb.NumberDataPoint{{
+						Attributes:   attrs,
+						TimeUnixNano: uint64(m.Timestamp) * 1e9,
+						Value:        &metricpb.NumberDataPoint_AsDouble{AsDouble: m.Value},
+					}},
+				}},
+			})
+		case "histogram":
+			key := histogramGroupKey(m)
+			g, ok := histograms[key]
+			if !ok {
+				g = &histogramGroup{name: m.Name, timestamp: m.Timestamp}
+				histograms[key] = g
+				histogramOrder = append(histogramOrder, key)
+			}
+			if g.attrs == nil {
+				g.attrs = attrs
+			}
+			g.values = append(g.values, m.Value)
+		default:
+			out = append(out, &metricpb.Metric{
+				Name: m.Name,
+				Data: &metricpb.Metric_Gauge{Gauge: &metricpb.Gauge{
+					DataPoints: []*metricpb.NumberDataPoint{{
+						Attributes:   attrs,
+						TimeUnixNano: uint64(m.Timestamp) * 1e9,
+						Value:        &metricpb.NumberDataPoint_AsDouble{AsDouble: m.Value},
+					}},
+				}},
+			})
+		}
+	}
+
+	for _, key := range histogramOrder {
+		g := histograms[key]
+		out = append(out, &metricpb.Metric{
+			Name: g.name,
+			Data: &metricpb.Metric_ExponentialHistogram{ExponentialHistogram: &metricpb.ExponentialHistogram{
+				AggregationTemporality: metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+				DataPoints:             []*metricpb.ExponentialHistogramDataPoint{g.toDataPoint()},
+			}},
+		})
+	}
+	return out
+}
+
+// histogramScale fixes the exponential histogram's base to 2^(2^-4), a
+// granularity close enough to distinguish adjacent percentiles (eg p95 vs
+// p99) without needing a per-metric scale search.
+const histogramScale = 4
+
+// histogramGroup accumulates the percentile values that belong to a single
+// (name, non-percentile tags) histogram before they are bucketed into one
+// ExponentialHistogramDataPoint.
+type histogramGroup struct {
+	name      string
+	timestamp int64
+	attrs     []*commonpb.KeyValue
+	values    []float64
+}
+
+func (g *histogramGroup) toDataPoint() *metricpb.ExponentialHistogramDataPoint {
+	buckets := make(map[int32]uint64, len(g.values))
+	var sum float64
+	for _, v := range g.values {
+		sum += v
+		buckets[exponentialHistogramBucketIndex(v, histogramScale)]++
+	}
+
+	min, max := int32(0), int32(0)
+	first := true
+	for idx := range buckets {
+		if first || idx < min {
+			min = idx
+		}
+		if first || idx > max {
+			max = idx
+		}
+		first = false
+	}
+
+	counts := make([]uint64, max-min+1)
+	for idx, count := range buckets {
+		counts[idx-min] = count
+	}
+
+	return &metricpb.ExponentialHistogramDataPoint{
+		Attributes:   g.attrs,
+		TimeUnixNano: uint64(g.timestamp) * 1e9,
+		Count:        uint64(len(g.values)),
+		Sum:          &sum,
+		Scale:        histogramScale,
+		Positive: &metricpb.ExponentialHistogramDataPoint_Buckets{
+			Offset:       min,
+			BucketCounts: counts,
+		},
+	}
+}
+
+// histogramGroupKey identifies the ExponentialHistogramDataPoint that a
+// histogram DDMetric's percentile value belongs in: its name plus every tag
+// except the percentile tag itself, so "latency" tagged "p50,host:a" and
+// "latency" tagged "p99,host:a" land in the same group while "host:b" gets
+// its own.
+func histogramGroupKey(m DDMetric) string {
+	pctTag, ok := percentileTag(m)
+
+	tags := make([]string, 0, len(m.Tags))
+	for _, tag := range m.Tags {
+		if ok && tag == pctTag {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return m.Name + "\x00" + strings.Join(tags, ",")
+}
+
+// percentileTag returns the tag in m.Tags that names a veneur percentile
+// (eg "p50", "p99", "p999"), if any.
+func percentileTag(m DDMetric) (string, bool) {
+	for _, tag := range m.Tags {
+		if _, ok := percentileToQuantile(tag); ok {
+			return tag, true
+		}
+	}
+	return "", false
+}
+
+// exponentialHistogramBucketIndex returns the index of the bucket that
+// value falls into under OTLP's exponential histogram definition, where
+// bucket i covers the range (base^i, base^(i+1)] and base = 2^(2^-scale).
+func exponentialHistogramBucketIndex(value float64, scale int32) int32 {
+	if value <= 0 {
+		return 0
+	}
+	base := math.Pow(2, math.Pow(2, float64(-scale)))
+	return int32(math.Ceil(math.Log(value)/math.Log(base))) - 1
+}
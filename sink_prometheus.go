@@ -0,0 +1,147 @@
+package veneur
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// prometheusSink writes metrics to a Prometheus remote-write endpoint,
+// framing each WriteRequest as snappy-compressed protobuf per the
+// remote-write spec.
+//
+// veneur's histogram percentiles (eg p50, p99) are already pre-computed
+// per flush, so they are mapped onto a Prometheus summary's quantile
+// fields rather than re-bucketed into a true histogram.
+type prometheusSink struct {
+	url        string
+	httpClient *http.Client
+	maxRetries int
+}
+
+func newPrometheusSink(conf SinkConfig) (Sink, error) {
+	if conf.URL == "" {
+		return nil, fmt.Errorf("prometheus sink: URL is required")
+	}
+	return &prometheusSink{
+		url:        conf.URL,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		maxRetries: conf.MaxRetries,
+	}, nil
+}
+
+func (p *prometheusSink) Name() string {
+	return "prometheus"
+}
+
+func (p *prometheusSink) Flush(ctx context.Context, metrics []DDMetric) error {
+	req := &prompb.WriteRequest{
+		Timeseries: metricsToTimeseries(metrics),
+	}
+
+	data, err := req.Marshal()
+	if err != nil {
+		return fmt.Errorf("prometheus sink: marshaling WriteRequest: %v", err)
+	}
+	compressed := snappy.Encode(nil, data)
+
+	var lastErr error
+	attempts := p.maxRetries + 1
+	for attempt := 0; attempt < attempts; attempt++ {
+		if lastErr != nil {
+			// simple linear backoff between retries
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+		if lastErr = p.send(ctx, compressed); lastErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("prometheus sink: giving up after %d attempts: %v", attempts, lastErr)
+}
+
+func (p *prometheusSink) send(ctx context.Context, body []byte) error {
+	httpReq, err := http.NewRequest("POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building request: %v", err)
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := p.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("POST failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// metricsToTimeseries converts veneur's DDMetrics into Prometheus
+// remote-write timeseries. A DDMetric named "foo" with a "p99" percentile
+// tag becomes the series "foo" with a "quantile" label of "0.99", matching
+// how Prometheus summaries expose percentiles.
+func metricsToTimeseries(metrics []DDMetric) []*prompb.TimeSeries {
+	out := make([]*prompb.TimeSeries, 0, len(metrics))
+	for _, m := range metrics {
+		labels := []*prompb.Label{{Name: "__name__", Value: m.Name}}
+		for _, tag := range m.Tags {
+			if quantile, ok := percentileToQuantile(tag); ok {
+				labels = append(labels, &prompb.Label{Name: "quantile", Value: quantile})
+				continue
+			}
+			name, value := splitTag(tag)
+			labels = append(labels, &prompb.Label{Name: name, Value: value})
+		}
+
+		out = append(out, &prompb.TimeSeries{
+			Labels: labels,
+			Samples: []prompb.Sample{{
+				Value:     m.Value,
+				Timestamp: m.Timestamp * 1000,
+			}},
+		})
+	}
+	return out
+}
+
+// percentileToQuantile recognizes veneur's bare percentile tags ("p50",
+// "p99", "p999", ...) and converts them to the fractional quantile value
+// Prometheus summaries use ("0.5", "0.99", "0.999"). The digits after "p"
+// are read as a decimal fraction of themselves, eg "99" -> 99/100 -> 0.99,
+// "999" -> 999/1000 -> 0.999. Tags that aren't in this form (including any
+// "key:value" tag, since those always contain a colon) are left alone.
+func percentileToQuantile(tag string) (string, bool) {
+	if len(tag) < 2 || tag[0] != 'p' {
+		return "", false
+	}
+	digits := tag[1:]
+	n, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil {
+		return "", false
+	}
+	quantile := float64(n) / math.Pow(10, float64(len(digits)))
+	return strconv.FormatFloat(quantile, 'f', -1, 64), true
+}
+
+// splitTag turns a "key:value" statsd-style tag into a Prometheus label
+// name/value pair. Tags with no ":" become boolean-ish labels valued "true".
+func splitTag(tag string) (string, string) {
+	for i := 0; i < len(tag); i++ {
+		if tag[i] == ':' {
+			return tag[:i], tag[i+1:]
+		}
+	}
+	return tag, "true"
+}
@@ -0,0 +1,109 @@
+package veneur
+
+import (
+	"testing"
+
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitTag(t *testing.T) {
+	name, value := splitTag("host:abc123")
+	assert.Equal(t, "host", name)
+	assert.Equal(t, "abc123", value)
+
+	name, value = splitTag("urgent")
+	assert.Equal(t, "urgent", name)
+	assert.Equal(t, "true", value)
+}
+
+func TestNewSinkUnknownType(t *testing.T) {
+	_, err := newSink(SinkConfig{Type: "carrier-pigeon"})
+	assert.Error(t, err)
+}
+
+func TestPercentileToQuantile(t *testing.T) {
+	quantile, ok := percentileToQuantile("p99")
+	assert.True(t, ok)
+	assert.Equal(t, "0.99", quantile)
+
+	quantile, ok = percentileToQuantile("p50")
+	assert.True(t, ok)
+	assert.Equal(t, "0.5", quantile)
+
+	quantile, ok = percentileToQuantile("p999")
+	assert.True(t, ok)
+	assert.Equal(t, "0.999", quantile)
+
+	_, ok = percentileToQuantile("host:abc123")
+	assert.False(t, ok, "key:value tags are never percentile tags")
+
+	_, ok = percentileToQuantile("urgent")
+	assert.False(t, ok, "bare non-numeric tags are not percentile tags")
+}
+
+func TestMetricsToTimeseriesPercentileTag(t *testing.T) {
+	metrics := []DDMetric{
+		{Name: "request.latency", Type: "histogram", Value: 42.0, Tags: []string{"p99", "host:a"}},
+	}
+
+	out := metricsToTimeseries(metrics)
+	assert.Len(t, out, 1)
+
+	var quantile, host string
+	var sawName bool
+	for _, label := range out[0].Labels {
+		switch label.Name {
+		case "quantile":
+			quantile = label.Value
+		case "host":
+			host = label.Value
+		case "__name__":
+			sawName = true
+		}
+	}
+	assert.True(t, sawName)
+	assert.Equal(t, "0.99", quantile, "a bare p99 tag should become a quantile label, not a p99=true label")
+	assert.Equal(t, "a", host)
+}
+
+func TestMetricsToOTLPHistogramPercentiles(t *testing.T) {
+	metrics := []DDMetric{
+		{Name: "request.latency", Type: "histogram", Value: 10, Tags: []string{"p50", "host:a"}},
+		{Name: "request.latency", Type: "histogram", Value: 500, Tags: []string{"p99", "host:a"}},
+		{Name: "request.latency", Type: "histogram", Value: 99, Tags: []string{"p50", "host:b"}},
+	}
+
+	out := metricsToOTLP(metrics)
+	assert.Len(t, out, 2, "host:a and host:b percentiles should land in separate data points")
+
+	hist := out[0].Data.(*metricpb.Metric_ExponentialHistogram).ExponentialHistogram.DataPoints[0]
+	assert.Equal(t, uint64(2), hist.Count, "the host:a group should combine its p50 and p99 samples")
+
+	var total uint64
+	for _, c := range hist.Positive.BucketCounts {
+		total += c
+	}
+	assert.Equal(t, hist.Count, total, "every sample should land in exactly one bucket")
+
+	// the p50 (10) and p99 (500) values are far enough apart that they must
+	// not collapse into the same bucket
+	assert.Greater(t, len(hist.Positive.BucketCounts), 1)
+}
+
+func TestMetricsToOTLPHistogramSumNotAliased(t *testing.T) {
+	metrics := []DDMetric{
+		{Name: "a.histogram", Type: "histogram", Value: 1.5},
+		{Name: "b.histogram", Type: "histogram", Value: 2.5},
+	}
+
+	out := metricsToOTLP(metrics)
+	assert.Len(t, out, 2)
+
+	a := out[0].Data.(*metricpb.Metric_ExponentialHistogram).ExponentialHistogram.DataPoints[0]
+	b := out[1].Data.(*metricpb.Metric_ExponentialHistogram).ExponentialHistogram.DataPoints[0]
+
+	assert.Equal(t, 1.5, *a.Sum, "first histogram should keep its own value")
+	assert.Equal(t, 2.5, *b.Sum, "second histogram should keep its own value, not alias the first")
+}
@@ -0,0 +1,75 @@
+package veneur
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// NewSocket creates a UDP socket bound to addr with SO_REUSEPORT set, so
+// that multiple readers can bind the same address and have the kernel
+// load-balance datagrams across them. If rcvbuf is non-zero, the socket's
+// kernel receive buffer is resized to that many bytes.
+//
+// If the running kernel does not support SO_REUSEPORT, setsockopt fails
+// with EINVAL; NewSocket surfaces that as a clear error rather than a bare
+// errno, since a confusing "invalid argument" is easy to mistake for a bad
+// address.
+func NewSocket(addr *net.UDPAddr, rcvbuf int) (*net.UDPConn, error) {
+	var domain int
+	var sa syscall.Sockaddr
+
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		domain = syscall.AF_INET
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		domain = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		sa = sa6
+	}
+
+	fd, err := syscall.Socket(domain, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, fmt.Errorf("creating UDP socket: %v", err)
+	}
+	// os.NewFile takes ownership of fd; on any error path below we close
+	// via the *os.File so we don't leak it
+	file := os.NewFile(uintptr(fd), "veneur-udp-socket")
+
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1); err != nil {
+		file.Close()
+		if err == syscall.EINVAL {
+			return nil, fmt.Errorf("setting SO_REUSEPORT: kernel does not support SO_REUSEPORT; set NumReaders to 1 or upgrade the kernel")
+		}
+		return nil, fmt.Errorf("setting SO_REUSEPORT: %v", err)
+	}
+
+	if rcvbuf != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvbuf); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("setting SO_RCVBUF: %v", err)
+		}
+	}
+
+	if err := syscall.Bind(fd, sa); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("binding UDP socket: %v", err)
+	}
+
+	conn, err := net.FilePacketConn(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("wrapping UDP socket: %v", err)
+	}
+
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected connection type %T for UDP socket", conn)
+	}
+	return udpConn, nil
+}
@@ -0,0 +1,23 @@
+package veneur
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSocketReusePort(t *testing.T) {
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	first, err := NewSocket(addr, 0)
+	assert.NoError(t, err)
+	defer first.Close()
+
+	// a second socket bound to the same address should succeed because of
+	// SO_REUSEPORT, letting the kernel load-balance datagrams between them
+	second, err := NewSocket(first.LocalAddr().(*net.UDPAddr), 0)
+	assert.NoError(t, err)
+	defer second.Close()
+}